@@ -4,18 +4,21 @@
 package gcsproxy
 
 import (
-	"container/list"
+	"container/heap"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcsutil"
 	"github.com/jacobsa/gcsfuse/timeutil"
 	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/cloud/storage"
 )
 
@@ -66,8 +69,16 @@ import (
 // non-empty (enchilada/), and others are implicitly defined by
 // their children (queso/carne/).
 //
-// Not safe for concurrent access. The user must provide external
-// synchronization if necessary.
+// Not safe for concurrent access in general. The user must provide external
+// synchronization for List, Snapshot, Diff, and CheckInvariants.
+//
+// The exceptions are WaitForChange, NoteNewObject, NoteNewSubdirectory, and
+// NoteRemoval, which are designed to be called from a goroutine other than
+// whichever one is driving the rest of this type's API: they, along with a
+// background listing kicked off internally by List when a
+// stale-while-revalidate refresh is due (see ensureContents), touch
+// contents/contentsExpiration/swrDeadline/generation/childModifications/
+// childModificationsIndex only while holding mu.
 type ListingProxy struct {
 	/////////////////////////
 	// Dependencies
@@ -87,6 +98,13 @@ type ListingProxy struct {
 	// Mutable state
 	/////////////////////////
 
+	// Guards contents, contentsExpiration, swrDeadline, generation,
+	// changeSeqCounter, childModifications, and childModificationsIndex,
+	// since a stale-while-revalidate refresh may update them from a
+	// goroutine other than the one driving the rest of this type's API. See
+	// the comment on ListingProxy.
+	mu sync.Mutex
+
 	// Our current best understanding of the contents of the directory in GCS,
 	// formed by listing the bucket and then patching according to child
 	// modification records at the time, and patched since then by subsequent
@@ -94,40 +112,118 @@ type ListingProxy struct {
 	//
 	// The time after which this should be generated anew from a new listing is
 	// also stored. This is set to the time at which the listing completed plus
-	// the listing cache TTL.
+	// a jittered listing cache TTL.
 	//
 	// Sub-directories are of type string, and objects are of type
 	// *storage.Object.
 	//
 	// INVARIANT: contents != nil
-	// INVARIANT: All values are of type string or *storage.Object.
-	// INVARIANT: For all string values v, checkSubdirName(v) == nil
-	// INVARIANT: For all object values o, checkObjectName(o.Name) != nil
+	// INVARIANT: All node values are of type string or *storage.Object.
+	// INVARIANT: For all string node values v, checkSubdirName(v) == nil
+	// INVARIANT: For all object node values o, checkObjectName(o.Name) == nil
 	// INVARIANT: All entries are indexed by the correct name.
-	contents           map[string]interface{}
+	//
+	// GUARDED_BY(mu)
+	contents           map[string]contentsEntry
 	contentsExpiration time.Time
 
-	// A collection of children that have recently been added or removed locally
-	// and the time at which it happened, ordered by the sequence in which it
-	// happened. Elements M with M.node == nil are removals; all others are
-	// additions.
+	// The end of the stale-while-revalidate window: up to this point past
+	// contentsExpiration, ensureContents returns the (stale) contents
+	// immediately and kicks off a deduplicated background refresh rather
+	// than blocking on gcsutil.List. See ListingProxy_StaleWhileRevalidateWindow.
+	//
+	// GUARDED_BY(mu)
+	swrDeadline time.Time
+
+	// Deduplicates concurrent background refreshes so that only one
+	// goroutine per directory ever calls gcsutil.List at a time, keyed on
+	// lp.name.
+	refreshGroup singleflight.Group
+
+	// Bumped each time ensureContents regenerates contents from a fresh
+	// listing, whether or not any individual entry actually changed. Exposed
+	// via Snapshot so that callers can cheaply tell two snapshots apart
+	// without comparing maps.
+	//
+	// GUARDED_BY(mu)
+	generation uint64
+
+	// The value handed out to the next entry created or overwritten in
+	// contents, then incremented. See contentsEntry.changeSeq.
+	//
+	// GUARDED_BY(mu)
+	changeSeqCounter uint64
+
+	// A log of every change to contents (additions, modifications, and
+	// removals), ordered by changeSeq, periodically compacted back down to
+	// changeLogCap entries once it grows past twice that (see
+	// recordChangeLocked). Lets diffLocked find the names that changed
+	// since a Snapshot by binary searching for the first entry past the
+	// Snapshot's high-water changeSeq instead of scanning all of contents.
+	//
+	// INVARIANT: Sorted by changeSeq, strictly increasing.
+	// INVARIANT: len(changeLog) <= 2*changeLogCap
 	//
-	// For a record M in this list with M's age less than the modification TTL,
-	// any listing from the bucket should be augmented by pretending M just
-	// happened.
+	// GUARDED_BY(mu)
+	changeLog []changeLogEntry
+
+	// Broadcast whenever contents, contentsExpiration, or generation change,
+	// so that WaitForChange can avoid polling. Backed by mu.
+	changeCond *sync.Cond
+
+	// A collection of children that have recently been added or removed
+	// locally, ordered as a min-heap by expiration so that
+	// cleanChildModifications can cheaply find and evict the ones that have
+	// gone stale without scanning the whole collection. Elements M with
+	// M.node == nil are removals (and double as the negative-existence
+	// cache consulted by Stat); all others are additions.
+	//
+	// For a record M in this heap with M's age less than the modification
+	// TTL, any listing from the bucket should be augmented by pretending M
+	// just happened.
 	//
-	// INVARIANT: All elements are of type childModification.
 	// INVARIANT: Contains no duplicate names.
 	// INVARIANT: For each M with M.node == nil, contents does not contain M.name.
 	// INVARIANT: For each M with M.node != nil, contents[M.name] == M.node.
-	childModifications list.List
+	// INVARIANT: childModifications satisfies the container/heap invariants.
+	//
+	// GUARDED_BY(mu)
+	childModifications childModHeap
 
 	// An index of childModifications by name.
 	//
 	// INVARIANT: childModificationsIndex != nil
 	// INVARIANT: For all names N in the map, the indexed modification has name N.
 	// INVARIANT: Contains exactly the set of names in childModifications.
-	childModificationsIndex map[string]*list.Element
+	//
+	// GUARDED_BY(mu)
+	childModificationsIndex map[string]*childModification
+}
+
+// A single value in ListingProxy.contents.
+type contentsEntry struct {
+	// INVARIANT: node is of type string or *storage.Object.
+	node interface{}
+
+	// Monotonically increasing within a given ListingProxy, bumped whenever
+	// this entry is created or overwritten by playBackModificationLocked or
+	// by ensureContents noticing that the entry actually changed. Lets Diff
+	// tell which entries differ from a Snapshot without comparing every
+	// *storage.Object by value.
+	changeSeq uint64
+}
+
+// A single recorded change to ListingProxy.contents, appended to
+// ListingProxy.changeLog each time recordChangeLocked hands out a new
+// changeSeq.
+type changeLogEntry struct {
+	changeSeq uint64
+	name      string
+
+	// The node as of this change, or nil if this entry records a removal.
+	//
+	// INVARIANT: node == nil or node is of type string or *storage.Object
+	node interface{}
 }
 
 // See ListingProxy.childModifications.
@@ -137,6 +233,43 @@ type childModification struct {
 
 	// INVARIANT: node == nil or node is of type string or *storage.Object
 	node interface{}
+
+	// This element's current position within childModHeap, maintained by
+	// its Swap and cleared (-1) once popped. Lets recordModification evict a
+	// superseded record in O(log n) via heap.Remove instead of a scan.
+	index int
+}
+
+// A min-heap of *childModification ordered by expiration, implementing
+// container/heap.Interface. See ListingProxy.childModifications.
+type childModHeap []*childModification
+
+func (h childModHeap) Len() int { return len(h) }
+
+func (h childModHeap) Less(i, j int) bool {
+	return h[i].expiration.Before(h[j].expiration)
+}
+
+func (h childModHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *childModHeap) Push(x interface{}) {
+	m := x.(*childModification)
+	m.index = len(*h)
+	*h = append(*h, m)
+}
+
+func (h *childModHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	m := old[n-1]
+	old[n-1] = nil
+	m.index = -1
+	*h = old[:n-1]
+	return m
 }
 
 // How long we cache the most recent listing for a particular directory from
@@ -195,9 +328,10 @@ func NewListingProxy(
 		bucket:                  bucket,
 		clock:                   clock,
 		name:                    dir,
-		contents:                make(map[string]interface{}),
-		childModificationsIndex: make(map[string]*list.Element),
+		contents:                make(map[string]contentsEntry),
+		childModificationsIndex: make(map[string]*childModification),
 	}
+	lp.changeCond = sync.NewCond(&lp.mu)
 
 	return
 }
@@ -222,16 +356,18 @@ func (lp *ListingProxy) CheckInvariants() {
 	}
 
 	// Check each element of the contents map.
-	for k, node := range lp.contents {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	for k, entry := range lp.contents {
 		// Check that the key is legal.
 		if !(strings.HasPrefix(k, lp.name) && k != lp.name) {
 			panic(fmt.Sprintf("Name %s is not a strict prefix of key %s", lp.name, k))
 		}
 
 		// Type-specific logic
-		switch typedNode := node.(type) {
+		switch typedNode := entry.node.(type) {
 		default:
-			panic(fmt.Sprintf("Bad type for node: %v", node))
+			panic(fmt.Sprintf("Bad type for node: %v", entry.node))
 
 		case string:
 			// Sub-directory
@@ -254,20 +390,30 @@ func (lp *ListingProxy) CheckInvariants() {
 		}
 	}
 
-	// Check each child modification. Build a list of names we've seen while
-	// doing so.
+	// Check each child modification, and the heap invariant itself. Build a
+	// list of names we've seen while doing so.
 	var listNames sort.StringSlice
-	for e := lp.childModifications.Front(); e != nil; e = e.Next() {
-		m := e.Value.(childModification)
+	for i, m := range lp.childModifications {
 		listNames = append(listNames, m.name)
 
+		if m.index != i {
+			panic(fmt.Sprintf("Index mismatch for %s: %d vs. %d", m.name, m.index, i))
+		}
+
+		for _, c := range [2]int{2*i + 1, 2*i + 2} {
+			if c < len(lp.childModifications) &&
+				lp.childModifications[c].expiration.Before(m.expiration) {
+				panic(fmt.Sprintf("Heap invariant violated at index %d", i))
+			}
+		}
+
 		if m.node == nil {
 			if n, ok := lp.contents[m.name]; ok {
-				panic(fmt.Sprintf("lp.contents[%s] == %v for removal", m.name, n))
+				panic(fmt.Sprintf("lp.contents[%s] == %v for removal", m.name, n.node))
 			}
 		} else {
-			if n := lp.contents[m.name]; n != m.node {
-				panic(fmt.Sprintf("lp.contents[%s] == %v, not %v", m.name, n, m.node))
+			if n := lp.contents[m.name]; n.node != m.node {
+				panic(fmt.Sprintf("lp.contents[%s] == %v, not %v", m.name, n.node, m.node))
 			}
 		}
 	}
@@ -287,10 +433,9 @@ func (lp *ListingProxy) CheckInvariants() {
 
 	// Check the index. Build a list of names it contains While doing so.
 	var indexNames sort.StringSlice
-	for name, e := range lp.childModificationsIndex {
+	for name, m := range lp.childModificationsIndex {
 		indexNames = append(indexNames, name)
 
-		m := e.Value.(childModification)
 		if m.name != name {
 			panic(fmt.Sprintf("Index name mismatch: %s vs. %s", m.name, name))
 		}
@@ -319,8 +464,10 @@ func (lp *ListingProxy) List(
 	}
 
 	// Read out the contents.
-	for name, node := range lp.contents {
-		switch typedNode := node.(type) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	for name, entry := range lp.contents {
+		switch typedNode := entry.node.(type) {
 		case *storage.Object:
 			objects = append(objects, typedNode)
 
@@ -348,23 +495,11 @@ func (lp *ListingProxy) NoteNewObject(o *storage.Object) (err error) {
 		return
 	}
 
-	// Delete any existing record for this name.
-	if e, ok := lp.childModificationsIndex[name]; ok {
-		lp.childModifications.Remove(e)
-		delete(lp.childModificationsIndex, name)
-	}
-
-	// Add a record.
-	m := childModification{
+	lp.recordModification(childModification{
 		expiration: lp.clock.Now().Add(ListingProxy_ModificationMemoryTTL),
 		name:       name,
 		node:       o,
-	}
-
-	lp.childModificationsIndex[m.name] = lp.childModifications.PushBack(m)
-
-	// Ensure the record is reflected in the contents.
-	lp.playBackModification(m)
+	})
 
 	return
 }
@@ -386,19 +521,117 @@ func (lp *ListingProxy) NoteNewSubdirectory(name string) (err error) {
 		return
 	}
 
-	err = errors.New("TODO: Implement NoteNewSubdirectory.")
+	lp.recordModification(childModification{
+		expiration: lp.clock.Now().Add(ListingProxy_ModificationMemoryTTL),
+		name:       name,
+		node:       name,
+	})
+
 	return
 }
 
-// Note that an object or directory prefix has been removed from the directory,
-// overriding any previous additions or removals. For awhile after this call,
-// the response to a call to List will not contain this name even if it is
-// present in a listing from the underlying bucket.
+// Note that an object or directory prefix has been removed from the
+// directory, or confirmed to not exist in it (e.g. because a fuse Lookup
+// already came back empty), overriding any previous additions or removals.
+// For awhile after this call, the response to a call to List will not
+// contain this name even if it is present in a listing from the underlying
+// bucket, and Stat will report it as NegativelyCached.
 func (lp *ListingProxy) NoteRemoval(name string) (err error) {
 	// When we're finished, trim any expired modifications.
 	defer lp.cleanChildModifications()
 
-	err = errors.New("TODO: Implement NoteRemoval.")
+	if err = lp.checkChildName(name); err != nil {
+		err = fmt.Errorf("Illegal child name (%v): %s", err, name)
+		return
+	}
+
+	lp.recordModification(childModification{
+		expiration: lp.clock.Now().Add(ListingProxy_ModificationMemoryTTL),
+		name:       name,
+		node:       nil,
+	})
+
+	return
+}
+
+// Replace any existing record for m.name with m, and ensure it's reflected
+// in lp.contents.
+func (lp *ListingProxy) recordModification(m childModification) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if old, ok := lp.childModificationsIndex[m.name]; ok {
+		heap.Remove(&lp.childModifications, old.index)
+		delete(lp.childModificationsIndex, m.name)
+	}
+
+	mp := new(childModification)
+	*mp = m
+	heap.Push(&lp.childModifications, mp)
+	lp.childModificationsIndex[mp.name] = mp
+
+	lp.playBackModificationLocked(*mp)
+}
+
+// How present a name is known to be within a directory, as reported by
+// Stat. Unlike List, Stat never triggers a fresh listing: it only consults
+// state already cached locally, so callers who need an authoritative answer
+// for an Unknown name must still fall back to List.
+type Presence int
+
+const (
+	// The name is not present in contents, and there is no local record of
+	// its having been removed or confirmed absent either. The caller must
+	// fall back to List (or Stat again after one) to get an answer.
+	Unknown Presence = iota
+
+	// The name is present in contents, but the listing it came from may have
+	// expired; a concurrent foreign write could have since changed it.
+	PresentCached
+
+	// The name is present in contents, and that listing has not yet expired.
+	PresentAuthoritative
+
+	// The name is covered by a not-yet-expired NoteRemoval record: it was
+	// locally removed, or confirmed absent, within ModificationMemoryTTL.
+	NegativelyCached
+)
+
+// Report whether name is known to be present or absent in the directory,
+// based purely on lp's local cache (contents and the negative-existence
+// records kept in childModifications), without listing the bucket. This
+// lets a fuse Lookup answer ENOENT for a recently-removed or
+// recently-confirmed-absent child without re-listing a large directory.
+func (lp *ListingProxy) Stat(name string) (entry Entry, presence Presence, err error) {
+	if err = lp.checkChildName(name); err != nil {
+		err = fmt.Errorf("Illegal child name (%v): %s", err, name)
+		return
+	}
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	ce, haveContents := lp.contents[name]
+	fresh := lp.clock.Now().Before(lp.contentsExpiration)
+
+	if haveContents {
+		entry = entryForContentsEntry(name, ce)
+		if fresh {
+			presence = PresentAuthoritative
+		} else {
+			presence = PresentCached
+		}
+
+		return
+	}
+
+	if m, ok := lp.childModificationsIndex[name]; ok && m.node == nil &&
+		lp.clock.Now().Before(m.expiration) {
+		presence = NegativelyCached
+		return
+	}
+
+	presence = Unknown
 	return
 }
 
@@ -446,16 +679,72 @@ func (lp *ListingProxy) checkSubdirName(name string) (err error) {
 	return
 }
 
-// If lp.contents is up to date, do nothing. Otherwise, regenerate it.
+// Check that name is a legal name for some child of this directory, whether
+// an object or a sub-directory.
+func (lp *ListingProxy) checkChildName(name string) (err error) {
+	if isDirName(name) {
+		return lp.checkSubdirName(name)
+	}
+
+	return lp.checkObjectName(name)
+}
+
+// How long, past contentsExpiration, a caller gets back the stale contents
+// immediately while a single background goroutine refreshes them, rather
+// than blocking on its own call to gcsutil.List. See ensureContents.
+const ListingProxy_StaleWhileRevalidateWindow = 30 * time.Second
+
+// If lp.contents is up to date, do nothing.
+//
+// If it's stale but within the stale-while-revalidate window, kick off (if
+// one isn't already running) a single background goroutine to refresh it
+// and return immediately with the stale contents still in place.
+//
+// Otherwise block on a foreground refresh, as a caller arriving this late
+// has no fresher data to fall back on. Either way, at most one goroutine
+// per directory is ever actually listing the bucket at a time; concurrent
+// callers past the SWR window all wait on that same refresh.
 func (lp *ListingProxy) ensureContents(ctx context.Context) (err error) {
-	// Is the map up to date?
-	if lp.clock.Now().Before(lp.contentsExpiration) {
-		return
+	lp.mu.Lock()
+	now := lp.clock.Now()
+	fresh := now.Before(lp.contentsExpiration)
+	stale := !fresh && now.Before(lp.swrDeadline)
+	lp.mu.Unlock()
+
+	switch {
+	case fresh:
+		return nil
+
+	case stale:
+		lp.kickBackgroundRefresh()
+		return nil
+
+	default:
+		_, err = lp.refreshGroup.Do(lp.name, func() (interface{}, error) {
+			return nil, lp.refresh(ctx)
+		})
+		return err
 	}
+}
 
-	// We will build a new map.
-	contents := make(map[string]interface{})
+// Start a goroutine that calls refresh via lp.refreshGroup, which joins a
+// refresh for lp.name already in flight rather than starting a second
+// listing. Errors are dropped: the caller already
+// has a usable (if stale) answer, and the next caller past the SWR window
+// will retry synchronously and see any persistent error.
+func (lp *ListingProxy) kickBackgroundRefresh() {
+	go func() {
+		lp.refreshGroup.Do(lp.name, func() (interface{}, error) {
+			return nil, lp.refresh(context.Background())
+		})
+	}()
+}
 
+// Regenerate lp.contents from a fresh bucket listing and swap it in, along
+// with freshly-jittered contentsExpiration and swrDeadline. Should only be
+// invoked through lp.refreshGroup, which ensures at most one call per
+// lp.name is ever in flight.
+func (lp *ListingProxy) refresh(ctx context.Context) (err error) {
 	// List the directory.
 	query := &storage.Query{
 		Delimiter: "/",
@@ -464,10 +753,15 @@ func (lp *ListingProxy) ensureContents(ctx context.Context) (err error) {
 
 	objects, subdirs, err := gcsutil.List(ctx, lp.bucket, query)
 	if err != nil {
-		err = fmt.Errorf("gcsutil.List: %v", err)
-		return
+		return fmt.Errorf("gcsutil.List: %v", err)
 	}
 
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	// We will build a new map.
+	contents := make(map[string]contentsEntry)
+
 	// Process the returned objects.
 	for _, o := range objects {
 		// Special case: a placeholder object for the directory itself will show up
@@ -482,7 +776,7 @@ func (lp *ListingProxy) ensureContents(ctx context.Context) (err error) {
 			return
 		}
 
-		contents[o.Name] = o
+		lp.mergeEntryLocked(contents, o.Name, o)
 	}
 
 	// Process the returned prefixes.
@@ -502,55 +796,140 @@ func (lp *ListingProxy) ensureContents(ctx context.Context) (err error) {
 			return
 		}
 
-		contents[subdir] = subdir
+		lp.mergeEntryLocked(contents, subdir, subdir)
+	}
+
+	// Record a removal for any name that was present before this refresh but
+	// didn't show up in the fresh listing, so changeLog (and therefore
+	// diffLocked's fast path) doesn't miss it.
+	for name := range lp.contents {
+		if _, ok := contents[name]; !ok {
+			lp.recordChangeLocked(name, nil)
+		}
 	}
 
 	// Trim any expired modifications.
-	lp.cleanChildModifications()
+	lp.cleanChildModificationsLocked()
 
-	// Swap in the new map and update the expiration time.
+	// Swap in the new map and update the expiration times, each jittered
+	// independently by up to +/-20% based on lp.name so that a readdir storm
+	// across many sibling directories doesn't refresh them all in lockstep.
+	now := lp.clock.Now()
 	lp.contents = contents
-	lp.contentsExpiration = lp.clock.Now().Add(ListingProxy_ListingCacheTTL)
+	lp.contentsExpiration = now.Add(jitteredDuration(ListingProxy_ListingCacheTTL, lp.name))
+	lp.swrDeadline = lp.contentsExpiration.Add(
+		jitteredDuration(ListingProxy_StaleWhileRevalidateWindow, lp.name+"\x00swr"))
+	lp.generation++
 
 	// Play back child modifications.
-	for e := lp.childModifications.Front(); e != nil; e = e.Next() {
-		lp.playBackModification(e.Value.(childModification))
+	for _, m := range lp.childModifications {
+		lp.playBackModificationLocked(*m)
 	}
 
-	return
+	lp.changeCond.Broadcast()
+
+	return nil
+}
+
+// Scale base by a deterministic +/-20% jitter derived from key, so that
+// independent ListingProxy instances (e.g. sibling directories) pick
+// different, but stable, effective TTLs instead of all expiring at once.
+func jitteredDuration(base time.Duration, key string) time.Duration {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+
+	const spread = 0.2
+	frac := (float64(h.Sum32()%10001)/10000.0*2 - 1) * spread
+
+	return base + time.Duration(float64(base)*frac)
 }
 
+// Add an entry for name to contents (a map under construction by refresh),
+// reusing the changeSeq from lp.contents if node is unchanged from what's
+// there now so that Diff can skip untouched entries.
+//
+// REQUIRES: lp.mu is held.
+func (lp *ListingProxy) mergeEntryLocked(
+	contents map[string]contentsEntry,
+	name string,
+	node interface{}) {
+	if old, ok := lp.contents[name]; ok && reflect.DeepEqual(old.node, node) {
+		contents[name] = old
+		return
+	}
+
+	contents[name] = contentsEntry{node: node, changeSeq: lp.recordChangeLocked(name, node)}
+}
+
+// The number of entries changeLog is compacted back down to once it grows
+// past twice this, bounding memory if a caller holds on to a Snapshot
+// indefinitely. diffLocked falls back to a full scan of contents if base
+// predates the oldest retained entry.
+const changeLogCap = 4096
+
+// Return a fresh, monotonically increasing sequence number for use in a
+// contentsEntry, and append a record of the change to changeLog so that
+// diffLocked can find it without scanning all of contents.
+//
+// REQUIRES: lp.mu is held.
+func (lp *ListingProxy) recordChangeLocked(name string, node interface{}) uint64 {
+	lp.changeSeqCounter++
+	seq := lp.changeSeqCounter
+
+	lp.changeLog = append(
+		lp.changeLog,
+		changeLogEntry{changeSeq: seq, name: name, node: node})
+
+	// Compact only once we're well past changeLogCap, and back down to
+	// exactly changeLogCap, so the O(changeLogCap) copy this does is
+	// amortized over changeLogCap appends rather than paid on every one.
+	if len(lp.changeLog) > 2*changeLogCap {
+		lp.changeLog = append(
+			[]changeLogEntry(nil),
+			lp.changeLog[len(lp.changeLog)-changeLogCap:]...)
+	}
+
+	return seq
+}
+
+// Evict every modification whose expiration has passed. Because
+// childModifications is a min-heap keyed by expiration, this is O(log n)
+// amortized per evicted entry rather than a scan of the whole collection.
 func (lp *ListingProxy) cleanChildModifications() {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.cleanChildModificationsLocked()
+}
+
+// REQUIRES: lp.mu is held.
+func (lp *ListingProxy) cleanChildModificationsLocked() {
 	now := lp.clock.Now()
 
-	// The simple way: build a list of names of expired modifications to remove.
-	var names []string
-	for e := lp.childModifications.Front(); e != nil; e = e.Next() {
-		m := e.Value.(childModification)
+	for lp.childModifications.Len() > 0 {
+		m := lp.childModifications[0]
 
-		// Stop when we hit the first non-expired element. There may be expired
-		// ones further on if time is not monotonic, but meh.
+		// Stop once we hit the first non-expired element. The root of the
+		// min-heap has the earliest expiration, so no element below it has
+		// expired either.
 		if now.Before(m.expiration) {
 			break
 		}
 
-		names = append(names, m.name)
-	}
-
-	// Remove each name we noted above.
-	for _, name := range names {
-		e := lp.childModificationsIndex[name]
-		lp.childModifications.Remove(e)
-		delete(lp.childModificationsIndex, name)
+		heap.Pop(&lp.childModifications)
+		delete(lp.childModificationsIndex, m.name)
 	}
 }
 
-func (lp *ListingProxy) playBackModification(m childModification) {
+// REQUIRES: lp.mu is held.
+func (lp *ListingProxy) playBackModificationLocked(m childModification) {
 	// Removal?
 	if m.node == nil {
 		delete(lp.contents, m.name)
+		lp.recordChangeLocked(m.name, nil)
+		lp.changeCond.Broadcast()
 		return
 	}
 
-	lp.contents[m.name] = m.node
+	lp.contents[m.name] = contentsEntry{node: m.node, changeSeq: lp.recordChangeLocked(m.name, m.node)}
+	lp.changeCond.Broadcast()
 }
@@ -0,0 +1,67 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/cloud/storage"
+)
+
+// A minimal timeutil.Clock that just defers to the real wall clock. Good
+// enough here since ModificationMemoryTTL is minutes long and these tests
+// run in milliseconds.
+type realTimeClock struct{}
+
+func (realTimeClock) Now() time.Time { return time.Now() }
+
+// Regression test for a data race between the goroutine that plays back
+// NoteRemoval/NoteNewObject/NoteNewSubdirectory into childModifications and
+// a concurrent reader of lp.childModificationsIndex (as ensureContents's
+// background refresh and Stat do), caught by `go test -race`.
+func TestListingProxy_ConcurrentModificationsAndStat(t *testing.T) {
+	lp, err := NewListingProxy(nil, realTimeClock{}, "dir/")
+	if err != nil {
+		t.Fatalf("NewListingProxy: %v", err)
+	}
+
+	const iterations = 1000
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			if err := lp.NoteRemoval("dir/foo"); err != nil {
+				t.Errorf("NoteRemoval: %v", err)
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			if err := lp.NoteNewObject(&storage.Object{Name: "dir/foo"}); err != nil {
+				t.Errorf("NoteNewObject: %v", err)
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			// Exercises the same childModifications/childModificationsIndex
+			// state a background refresh's cleanChildModifications call
+			// would touch, concurrently with Stat's index read.
+			lp.cleanChildModifications()
+			if _, _, err := lp.Stat("dir/foo"); err != nil {
+				t.Errorf("Stat: %v", err)
+			}
+		}
+	}()
+
+	wg.Wait()
+}
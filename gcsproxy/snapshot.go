@@ -0,0 +1,209 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+// An immutable, point-in-time view of a ListingProxy's cached contents,
+// returned by Snapshot and consumed by Diff and WaitForChange.
+//
+// A Snapshot holds its own copy of the name -> entry map, so it remains
+// valid after the ListingProxy it came from is further mutated. Entries
+// are small (a change sequence number plus a shared *storage.Object or
+// directory name), so retaining many snapshots is cheap relative to the
+// number of objects they describe.
+type Snapshot struct {
+	contents           map[string]contentsEntry
+	contentsExpiration time.Time
+	generation         uint64
+
+	// The changeSeqCounter value at the time this snapshot was taken. Lets
+	// diffLocked find just the names that changed since, via
+	// ListingProxy.changeLog, instead of scanning all of contents.
+	seq uint64
+}
+
+// An entry describing a single name that differs between two snapshots (or
+// between a snapshot and the live contents), as returned by Diff.
+type Entry struct {
+	// The fully-qualified name of the object or directory.
+	Name string
+
+	// Is this entry a sub-directory, as opposed to an object?
+	IsDir bool
+
+	// The underlying object, set iff !IsDir.
+	Object *storage.Object
+}
+
+func entryForContentsEntry(name string, e contentsEntry) Entry {
+	switch node := e.node.(type) {
+	case *storage.Object:
+		return Entry{Name: name, Object: node}
+
+	case string:
+		return Entry{Name: name, IsDir: true}
+	}
+
+	panic("unreachable: bad contentsEntry node type")
+}
+
+// Return an immutable snapshot of lp's currently cached contents. Does not
+// trigger a fresh listing; call List first if you need the snapshot to
+// reflect GCS's current state rather than whatever lp has cached.
+func (lp *ListingProxy) Snapshot() Snapshot {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.snapshotLocked()
+}
+
+// REQUIRES: lp.mu is held.
+func (lp *ListingProxy) snapshotLocked() Snapshot {
+	contents := make(map[string]contentsEntry, len(lp.contents))
+	for name, entry := range lp.contents {
+		contents[name] = entry
+	}
+
+	return Snapshot{
+		contents:           contents,
+		contentsExpiration: lp.contentsExpiration,
+		generation:         lp.generation,
+		seq:                lp.changeSeqCounter,
+	}
+}
+
+// Report what has changed in lp's currently cached contents since base was
+// taken. An entry is "modified" if its changeSeq differs from the one it
+// had in base. refresh keeps an entry's changeSeq when the listed node is
+// unchanged, but playBackModificationLocked assigns a new one on every call
+// (including refresh's replay of child modifications), so an entry can be
+// reported as modified even when its node is equal to the old one. Diff finds the
+// changed names via lp.changeLog in O(changed) rather than scanning all of
+// contents, falling back to a full scan if base predates the oldest change
+// still retained in the log.
+func (lp *ListingProxy) Diff(base Snapshot) (added, removed, modified []Entry) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.diffLocked(base)
+}
+
+// REQUIRES: lp.mu is held.
+func (lp *ListingProxy) diffLocked(base Snapshot) (added, removed, modified []Entry) {
+	// changeLog only remembers the most recent changeLogCap changes. If base
+	// predates the oldest entry we still have, we can't trust it to name
+	// every change since base; fall back to comparing the full maps.
+	if len(lp.changeLog) > 0 && lp.changeLog[0].changeSeq > base.seq+1 {
+		return lp.diffLockedFullScan(base)
+	}
+
+	// Find the first changeLog entry past base's high-water changeSeq, then
+	// collect the distinct names touched from there on.
+	start := sort.Search(len(lp.changeLog), func(i int) bool {
+		return lp.changeLog[i].changeSeq > base.seq
+	})
+
+	seen := make(map[string]struct{}, len(lp.changeLog)-start)
+	for _, e := range lp.changeLog[start:] {
+		if _, ok := seen[e.name]; ok {
+			continue
+		}
+		seen[e.name] = struct{}{}
+
+		cur, curOK := lp.contents[e.name]
+		old, oldOK := base.contents[e.name]
+
+		switch {
+		case curOK && !oldOK:
+			added = append(added, entryForContentsEntry(e.name, cur))
+
+		case !curOK && oldOK:
+			removed = append(removed, entryForContentsEntry(e.name, old))
+
+		case curOK && oldOK && old.changeSeq != cur.changeSeq:
+			modified = append(modified, entryForContentsEntry(e.name, cur))
+		}
+	}
+
+	return
+}
+
+// A full scan of lp.contents and base.contents, used when base predates the
+// oldest entry retained in lp.changeLog.
+//
+// REQUIRES: lp.mu is held.
+func (lp *ListingProxy) diffLockedFullScan(base Snapshot) (added, removed, modified []Entry) {
+	for name, cur := range lp.contents {
+		old, ok := base.contents[name]
+		switch {
+		case !ok:
+			added = append(added, entryForContentsEntry(name, cur))
+
+		case old.changeSeq != cur.changeSeq:
+			modified = append(modified, entryForContentsEntry(name, cur))
+		}
+	}
+
+	for name, old := range base.contents {
+		if _, ok := lp.contents[name]; !ok {
+			removed = append(removed, entryForContentsEntry(name, old))
+		}
+	}
+
+	return
+}
+
+// REQUIRES: lp.mu is held.
+func (lp *ListingProxy) changedSinceLocked(base Snapshot) bool {
+	added, removed, modified := lp.diffLocked(base)
+	return len(added) > 0 || len(removed) > 0 || len(modified) > 0
+}
+
+// Block until lp's cached contents differ from base, then return a fresh
+// Snapshot reflecting the change. Returns early with ctx's error if ctx is
+// cancelled first.
+//
+// WaitForChange, like NoteNewObject, NoteNewSubdirectory, and NoteRemoval,
+// may be called from a goroutine other than the one driving lp: it's woken by NoteNewObject,
+// NoteNewSubdirectory, NoteRemoval, and refresh, all of which touch
+// lp.contents only while holding lp.mu, the same lock WaitForChange waits
+// on. See ListingProxy's top-level comment for what that does and doesn't
+// make safe to call concurrently.
+func (lp *ListingProxy) WaitForChange(
+	ctx context.Context,
+	base Snapshot) (snap Snapshot, err error) {
+	// Wake ourselves if ctx is cancelled while we're waiting on the cond.
+	stopWaiting := make(chan struct{})
+	defer close(stopWaiting)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			lp.mu.Lock()
+			lp.changeCond.Broadcast()
+			lp.mu.Unlock()
+		case <-stopWaiting:
+		}
+	}()
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	for !lp.changedSinceLocked(base) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			return
+		}
+
+		lp.changeCond.Wait()
+	}
+
+	snap = lp.snapshotLocked()
+	return
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/cloud/storage"
+)
+
+// Regression test for diffLocked scanning all of lp.contents and base on
+// every call. It should instead walk only the tail of changeLog past base's
+// high-water changeSeq, so a change to one name among many shouldn't force
+// touching the others.
+func TestListingProxy_DiffUsesChangeLog(t *testing.T) {
+	lp, err := NewListingProxy(nil, realTimeClock{}, "dir/")
+	if err != nil {
+		t.Fatalf("NewListingProxy: %v", err)
+	}
+
+	// Populate a handful of untouched entries, then take a base snapshot.
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("dir/untouched%d", i)
+		if err := lp.NoteNewObject(&storage.Object{Name: name}); err != nil {
+			t.Fatalf("NoteNewObject(%q): %v", name, err)
+		}
+	}
+
+	base := lp.Snapshot()
+
+	// Add, remove, and modify a few names after base was taken.
+	if err := lp.NoteNewObject(&storage.Object{Name: "dir/added"}); err != nil {
+		t.Fatalf("NoteNewObject: %v", err)
+	}
+
+	if err := lp.NoteRemoval("dir/untouched0"); err != nil {
+		t.Fatalf("NoteRemoval: %v", err)
+	}
+
+	if err := lp.NoteNewObject(&storage.Object{Name: "dir/untouched1"}); err != nil {
+		t.Fatalf("NoteNewObject: %v", err)
+	}
+
+	added, removed, modified := lp.Diff(base)
+
+	if len(added) != 1 || added[0].Name != "dir/added" {
+		t.Errorf("added = %v, want just dir/added", added)
+	}
+
+	if len(removed) != 1 || removed[0].Name != "dir/untouched0" {
+		t.Errorf("removed = %v, want just dir/untouched0", removed)
+	}
+
+	if len(modified) != 1 || modified[0].Name != "dir/untouched1" {
+		t.Errorf("modified = %v, want just dir/untouched1", modified)
+	}
+}
+
+// Regression test for the changeLog-eviction fallback path: once base
+// predates the oldest entry retained in changeLog, diffLocked must fall back
+// to a full scan rather than silently missing a change whose log entry has
+// been evicted.
+func TestListingProxy_DiffFallsBackAfterChangeLogEviction(t *testing.T) {
+	lp, err := NewListingProxy(nil, realTimeClock{}, "dir/")
+	if err != nil {
+		t.Fatalf("NewListingProxy: %v", err)
+	}
+
+	if err := lp.NoteNewObject(&storage.Object{Name: "dir/foo"}); err != nil {
+		t.Fatalf("NoteNewObject: %v", err)
+	}
+
+	base := lp.Snapshot()
+
+	// Modify dir/foo once, then churn enough other names through the log
+	// to evict the entry recording that modification. changeLog is only
+	// compacted once it grows past 2*changeLogCap entries.
+	if err := lp.NoteNewObject(&storage.Object{Name: "dir/foo"}); err != nil {
+		t.Fatalf("NoteNewObject: %v", err)
+	}
+
+	const churnCount = 2*changeLogCap + 10
+	for i := 0; i < churnCount; i++ {
+		name := fmt.Sprintf("dir/churn%d", i)
+		if err := lp.NoteNewObject(&storage.Object{Name: name}); err != nil {
+			t.Fatalf("NoteNewObject(%q): %v", name, err)
+		}
+	}
+
+	added, removed, modified := lp.Diff(base)
+
+	if len(added) != churnCount {
+		t.Errorf("len(added) = %d, want %d", len(added), churnCount)
+	}
+
+	if len(removed) != 0 {
+		t.Errorf("removed = %v, want none", removed)
+	}
+
+	if len(modified) != 1 || modified[0].Name != "dir/foo" {
+		t.Errorf("modified = %v, want just dir/foo", modified)
+	}
+}
@@ -0,0 +1,422 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcsfuse/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+// An entry yielded by Walk, describing either an object or a sub-directory
+// discovered somewhere in the sub-tree rooted at the directory on which Walk
+// was called.
+//
+// If Err is non-nil, this is the final entry that will ever be sent on the
+// channel: the walk has failed and the channel will be closed immediately
+// afterward. All other fields should be ignored in that case.
+type WalkEntry struct {
+	// The fully-qualified name of the object or directory, as it would appear
+	// in the contents of the owning ListingProxy.
+	Name string
+
+	// Is this entry a sub-directory, as opposed to an object?
+	IsDir bool
+
+	// The underlying object, set iff !IsDir.
+	Object *storage.Object
+
+	// Set iff this entry represents a failure of the walk as a whole.
+	Err error
+}
+
+// Options controlling the behavior of Walk.
+type WalkOptions struct {
+	// The maximum number of goroutines used to concurrently list
+	// sub-directories. If zero, WalkDefaultConcurrency is used.
+	Concurrency int
+
+	// The maximum number of '/'-delimited levels to descend below the
+	// directory Walk was called on. Zero means unlimited.
+	MaxDepth int
+
+	// How long an otherwise-idle worker waits for a new directory prefix to
+	// show up on the work queue before it exits, shrinking the pool. If
+	// zero, WalkDefaultIdleTimeout is used.
+	IdleTimeout time.Duration
+}
+
+// The default value used for WalkOptions.Concurrency when it is zero.
+const WalkDefaultConcurrency = 16
+
+// The default value used for WalkOptions.IdleTimeout when it is zero.
+const WalkDefaultIdleTimeout = 5 * time.Second
+
+// Returned (via WalkEntry.Err) when a walk descends past WalkOptions.MaxDepth.
+var ErrWalkTooDeep = errors.New("gcsproxy: walk exceeded MaxDepth")
+
+// Walk descends the entire sub-tree rooted at lp.name, emitting one
+// WalkEntry per object and per sub-directory it encounters.
+//
+// The walk is performed by a bounded pool of worker goroutines pulling
+// pending directory prefixes off a shared queue, so that independent
+// sub-trees are listed concurrently. Within a single directory, entries are
+// emitted in lexicographic order by name (see process). Because independent
+// sub-trees are listed concurrently, no particular order is guaranteed
+// between entries from different directories.
+//
+// Each worker lists a prefix with gcsutil.List and reuses a single
+// ListingProxy per prefix (creating one on demand, except for lp.name itself
+// which reuses lp) so that NoteNewObject/NoteNewSubdirectory/NoteRemoval on
+// those proxies are honored by the walk. The cache of proxies created for
+// other prefixes is scoped to this call to Walk; it is not shared with any
+// other walk.
+//
+// The returned channel is closed once the walk completes, whether
+// successfully or not; see WalkEntry.Err. Cancel ctx to abort the walk early
+// and drain any in-flight workers.
+func (lp *ListingProxy) Walk(
+	ctx context.Context,
+	opts WalkOptions) (entries <-chan WalkEntry, err error) {
+	concurrency := opts.Concurrency
+	if concurrency == 0 {
+		concurrency = WalkDefaultConcurrency
+	}
+
+	if concurrency < 1 {
+		err = fmt.Errorf("Illegal concurrency: %d", concurrency)
+		return
+	}
+
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = WalkDefaultIdleTimeout
+	}
+
+	w := &walker{
+		bucket:      lp.bucket,
+		clock:       lp.clock,
+		maxDepth:    opts.MaxDepth,
+		idleTimeout: idleTimeout,
+		out:         make(chan WalkEntry),
+		proxies:     map[string]*ListingProxy{lp.name: lp},
+	}
+	w.q.init()
+	w.q.push(walkItem{prefix: lp.name, depth: 0})
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			w.work(ctx)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		w.finish(ctx)
+	}()
+
+	entries = w.out
+	return
+}
+
+// A single pending unit of work: list the given prefix, which is at the
+// given depth below the root of the walk (the root itself is depth zero).
+type walkItem struct {
+	prefix string
+	depth  int
+}
+
+// Shared state for a single call to Walk.
+type walker struct {
+	bucket      gcs.Bucket
+	clock       timeutil.Clock
+	maxDepth    int
+	idleTimeout time.Duration
+
+	out chan WalkEntry
+
+	// Guards recording of the first fatal error, so that at most one is ever
+	// sent on out.
+	failOnce sync.Once
+
+	// Guards proxies, the per-walk cache of ListingProxy by prefix.
+	proxiesMu sync.Mutex
+	proxies   map[string]*ListingProxy
+
+	q walkQueue
+}
+
+// Return the cached ListingProxy for prefix, creating and caching one on
+// demand.
+func (w *walker) proxyForPrefix(prefix string) (lp *ListingProxy, err error) {
+	w.proxiesMu.Lock()
+	defer w.proxiesMu.Unlock()
+
+	if lp, ok := w.proxies[prefix]; ok {
+		return lp, nil
+	}
+
+	lp, err = NewListingProxy(w.bucket, w.clock, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	w.proxies[prefix] = lp
+	return lp, nil
+}
+
+// The body of a single worker goroutine: repeatedly pop a prefix off the
+// queue and process it until the queue drains, the walk is cancelled, or
+// the worker has been idle for longer than w.idleTimeout (in which case it
+// returns, shrinking the pool).
+func (w *walker) work(ctx context.Context) {
+	for {
+		item, ok := w.q.pop(ctx, w.idleTimeout)
+		if !ok {
+			return
+		}
+
+		w.process(ctx, item)
+		w.q.itemDone()
+	}
+}
+
+// List a single prefix and fan its results out to w.out, in lexicographic
+// order by name, and, for any sub-directories found, back onto the queue.
+func (w *walker) process(ctx context.Context, item walkItem) {
+	// Don't bother doing any work if the walk has already failed or been
+	// cancelled.
+	select {
+	case <-ctx.Done():
+		w.fail(ctx.Err())
+		return
+	default:
+	}
+
+	if w.maxDepth > 0 && item.depth > w.maxDepth {
+		w.fail(ErrWalkTooDeep)
+		return
+	}
+
+	lp, err := w.proxyForPrefix(item.prefix)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+
+	objects, subdirs, err := lp.List(ctx)
+	if err != nil {
+		w.fail(fmt.Errorf("Walk: lp.List(%q): %v", item.prefix, err))
+		return
+	}
+
+	toSend := make([]WalkEntry, 0, len(objects)+len(subdirs))
+	for _, o := range objects {
+		toSend = append(toSend, WalkEntry{Name: o.Name, Object: o})
+	}
+	for _, subdir := range subdirs {
+		toSend = append(toSend, WalkEntry{Name: subdir, IsDir: true})
+	}
+
+	sort.Slice(toSend, func(i, j int) bool { return toSend[i].Name < toSend[j].Name })
+
+	for _, e := range toSend {
+		if !w.send(ctx, e) {
+			return
+		}
+
+		if e.IsDir {
+			w.q.push(walkItem{prefix: e.Name, depth: item.depth + 1})
+		}
+	}
+}
+
+// Send an entry, honoring cancellation. Returns false if the walk has ended
+// (cancelled or already failed) and the caller should stop doing work.
+func (w *walker) send(ctx context.Context, e WalkEntry) bool {
+	select {
+	case w.out <- e:
+		return true
+	case <-w.q.closed():
+		return false
+	case <-ctx.Done():
+		w.fail(ctx.Err())
+		return false
+	}
+}
+
+// Record the first fatal error for the walk, if any, and wind the queue
+// down so that all workers eventually exit.
+func (w *walker) fail(err error) {
+	w.failOnce.Do(func() {
+		w.q.abort(err)
+	})
+}
+
+// Called once all workers have exited. Emits a terminal error entry, if
+// any, and closes the output channel.
+func (w *walker) finish(ctx context.Context) {
+	if err := w.q.err(); err != nil {
+		select {
+		case w.out <- WalkEntry{Err: err}:
+		case <-ctx.Done():
+		}
+	}
+
+	close(w.out)
+}
+
+// A FIFO queue of pending walkItems, shared by all of a walk's workers.
+//
+// A walk is considered complete, successfully, once the queue is empty and
+// no worker is still processing an item (outstanding == 0): at that point
+// there is by construction no way for new items to appear. A walk can also
+// end early due to cancellation or a worker error, signalled by abort.
+//
+// Not safe for concurrent access except via its methods.
+type walkQueue struct {
+	mu sync.Mutex
+
+	// Prefixes waiting to be listed.
+	items []walkItem
+
+	// The number of items that have been pushed but not yet passed to
+	// itemDone: i.e. items either still in the slice above or currently
+	// being processed by a worker.
+	outstanding int
+
+	// Closed, and replaced with a fresh channel, every time an item is
+	// pushed or outstanding is decremented, to wake any worker blocked in
+	// pop.
+	changed chan struct{}
+
+	// Closed exactly once, when the walk ends for any reason.
+	doneCh chan struct{}
+
+	// The walk's terminal error, if any. Only meaningful once doneCh is
+	// closed. A nil value indicates successful completion.
+	resultErr error
+}
+
+func (q *walkQueue) init() {
+	q.changed = make(chan struct{})
+	q.doneCh = make(chan struct{})
+}
+
+// Add a prefix to the queue, unless the walk has already ended.
+func (q *walkQueue) push(item walkItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case <-q.doneCh:
+		return
+	default:
+	}
+
+	q.items = append(q.items, item)
+	q.outstanding++
+	q.wakeLocked()
+}
+
+// Remove and return the next pending item, blocking until one is available.
+// Returns ok == false, with nothing further to do, if the walk has ended:
+// either because it completed, was cancelled, failed, or because the
+// calling worker has been idle for longer than idleTimeout (in which case
+// the worker should exit and shrink the pool).
+func (q *walkQueue) pop(
+	ctx context.Context,
+	idleTimeout time.Duration) (item walkItem, ok bool) {
+	for {
+		q.mu.Lock()
+
+		if len(q.items) > 0 {
+			item = q.items[0]
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return item, true
+		}
+
+		if q.outstanding == 0 {
+			q.finishLocked(nil)
+			q.mu.Unlock()
+			return walkItem{}, false
+		}
+
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-changed:
+			continue
+
+		case <-ctx.Done():
+			q.abort(ctx.Err())
+			return walkItem{}, false
+
+		case <-q.doneCh:
+			return walkItem{}, false
+
+		case <-time.After(idleTimeout):
+			return walkItem{}, false
+		}
+	}
+}
+
+// Record that a previously-popped item has finished being processed
+// (including pushing any of its children onto the queue).
+func (q *walkQueue) itemDone() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.outstanding--
+	q.wakeLocked()
+}
+
+// Wake any worker blocked in pop so it can re-examine the queue.
+func (q *walkQueue) wakeLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// End the walk early with the given error. (pop signals successful
+// completion by calling finishLocked(nil) directly.)
+func (q *walkQueue) abort(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finishLocked(err)
+}
+
+func (q *walkQueue) finishLocked(err error) {
+	select {
+	case <-q.doneCh:
+		return
+	default:
+	}
+
+	q.resultErr = err
+	close(q.doneCh)
+}
+
+// A channel that is closed once the walk has ended, for any reason.
+func (q *walkQueue) closed() <-chan struct{} {
+	return q.doneCh
+}
+
+// The walk's terminal error, if any. Only valid after closed() fires.
+func (q *walkQueue) err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.resultErr
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+// Author: jacobsa@google.com (Aaron Jacobs)
+
+package gcsproxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Regression test for a leak where a worker blocked in send, with no one
+// draining w.out, never noticed ctx had been cancelled: it wasn't selecting
+// on ctx.Done(), so it could never reach pop to call q.abort and unwind the
+// other workers.
+func TestWalker_SendUnblocksOnCancel(t *testing.T) {
+	w := &walker{out: make(chan WalkEntry)}
+	w.q.init()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- w.send(ctx, WalkEntry{Name: "foo"})
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Errorf("send returned true after ctx was cancelled")
+		}
+
+	case <-time.After(time.Second):
+		t.Fatalf("send did not unblock within 1s of ctx cancellation")
+	}
+
+	select {
+	case <-w.q.closed():
+	default:
+		t.Errorf("walk queue was not marked done after send's ctx was cancelled")
+	}
+
+	if err := w.q.err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("q.err() = %v, want context.Canceled", err)
+	}
+}
+
+// Regression test for a leak where finish sent the terminal error entry
+// with an unconditional blocking w.out <- ..., so a caller that cancelled
+// ctx and stopped reading left finish (and the unclosed channel) stuck
+// forever.
+func TestWalker_FinishUnblocksOnCancel(t *testing.T) {
+	w := &walker{out: make(chan WalkEntry)}
+	w.q.init()
+	w.q.abort(errors.New("boom"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan bool, 1)
+	go func() {
+		w.finish(ctx)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+
+	case <-time.After(time.Second):
+		t.Fatalf("finish did not unblock within 1s of ctx cancellation")
+	}
+
+	if _, ok := <-w.out; ok {
+		t.Errorf("w.out was not closed by finish")
+	}
+}